@@ -29,6 +29,7 @@ import (
 
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/dot"
 )
 
 // IntraListener receives usage statistics when a UDP or TCP socket is closed,
@@ -42,30 +43,75 @@ type IntraListener interface {
 // IntraTunnel represents an Intra session.
 type IntraTunnel interface {
 	Tunnel
-	// Get the DNSTransport (default: nil).
+	// Get the composed DNSTransport (default: nil).
 	GetDNS() doh.Transport
-	// Set the DNSTransport.  Once set, the tunnel will send DNS queries to
-	// this transport instead of forwarding them to `udpdns`/`tcpdns`.  The
-	// transport can be changed at any time during operation, but must not be nil.
-	SetDNS(doh.Transport)
+	// Set the DNSTransports to query, in priority order, and rebuild the
+	// composed transport.  Once set, the tunnel will send DNS queries to
+	// these transports instead of forwarding them to `udpdns`/`tcpdns`.  The
+	// transports can be changed at any time during operation, but the slice
+	// must not be empty.
+	SetDNS([]doh.Transport)
+	// SetDNSStrategy selects how the configured transports are dispatched
+	// (default: doh.First).
+	SetDNSStrategy(doh.Strategy)
+	// SetDoT makes `transport` the sole active DNS transport, for callers
+	// that want to use DNS-over-TLS instead of DNS-over-HTTPS.
+	SetDoT(dot.Transport)
 	// When set to true, Intra will pre-emptively split all HTTPS connections.
 	SetAlwaysSplitHTTPS(bool)
+	// When set to true (the default), a truncated UDP DNS response from
+	// `tcpdns`/`udpdns` is transparently retried over TCP.
+	SetDNSRetryOverTCP(bool)
+	// AddProxy registers a proxy Dialer under `id`, for use once SetRoute
+	// directs traffic to it.
+	AddProxy(id string, d intra.Dialer)
+	// RemoveProxy unregisters the proxy previously added under `id`.
+	RemoveProxy(id string)
+	// SetRoute installs the predicate used to choose a proxy ID for each
+	// non-DNS destination.  A nil route (the default) sends everything
+	// direct.
+	SetRoute(route func(*net.TCPAddr) string)
+	// SetOutboundInterface binds all future direct outbound sockets opened by
+	// the tunnel's UDP and TCP handlers to the network interface at
+	// `ifaceIndex`, so the tunnel can follow the device across Wi-Fi/cell
+	// transitions.  Pass an index of 0 to restore the system default
+	// interface.  DNS transports passed to SetDNS or SetDoT dial with their
+	// own dialers and are not bound.
+	SetOutboundInterface(ifaceIndex int) error
+	// SetDNSCache enables or disables in-tunnel DNS response caching
+	// (disabled by default).  If the IntraListener passed to NewIntraTunnel
+	// implements doh.CacheListener, it is notified of cache statistics after
+	// every cache lookup; callers that don't care about caching need not change it.
+	SetDNSCache(enabled bool)
 }
 
 type intratunnel struct {
 	*tunnel
-	tcp intra.TCPHandler
-	udp intra.UDPHandler
-	dns doh.Transport
+	tcp             intra.TCPHandler
+	udp             intra.UDPHandler
+	direct          *intra.DirectDialer // Shared direct route; always used for DNS, and the MultiDialer fallback.
+	dialer          *intra.MultiDialer  // Shared by tcp and udp for non-DNS traffic.
+	listener        IntraListener
+	dns             doh.Transport // The transport (possibly composed) currently in use.
+	dnsTransports   []doh.Transport
+	dnsStrategy     doh.Strategy
+	dnsCacheEnabled bool
 }
 
 // NewIntraTunnel creates a connected Intra session.
 //
 // `fakedns` is the DNS server (IP and port) that will be used by apps on the TUN device.
-//    This will normally be a reserved or remote IP address, port 53.
+//
+//	This will normally be a reserved or remote IP address, port 53.
+//
 // `udpdns` and `tcpdns` are the actual location of the DNS server in use.
-//    These will normally be localhost with a high-numbered port.
-// `dohdns` is the initial DOH transport.
+//
+//	These will normally be localhost with a high-numbered port.
+//
+// `dohdns` is the initial (sole) DOH transport; use SetDNS to configure
+//
+//	several transports with a dispatch Strategy once the tunnel is running.
+//
 // TODO: Remove `udpdns` and `tcpdns` once DOH-in-Go is fully rolled out.
 // `tunWriter` is the downstream VPN tunnel
 // `dialer` and `config` will be used for all network activity.
@@ -95,7 +141,7 @@ func NewIntraTunnel(fakedns, udpdns, tcpdns string, dohdns doh.Transport, fd int
 		return nil, err
 	}
 	if dohdns != nil {
-		t.SetDNS(dohdns)
+		t.SetDNS([]doh.Transport{dohdns})
 	}
 	if stackerr := netstack.EnableNIC(nicID); stackerr != nil {
 		return nil, errors.New(stackerr.String())
@@ -103,6 +149,19 @@ func NewIntraTunnel(fakedns, udpdns, tcpdns string, dohdns doh.Transport, fd int
 	return t, nil
 }
 
+// NewIntraTunnelWithDOHURL is like NewIntraTunnel, but builds the initial DOH
+// transport from `dohURL`, resolving its hostname via a doh.Bootstrap built
+// from `bootstrapDNS` (plain DNS "ip:port" servers) instead of requiring a
+// pre-resolved IP on the platform side.
+func NewIntraTunnelWithDOHURL(fakedns, udpdns, tcpdns, dohURL string, bootstrapDNS []string, fd int, dialer *net.Dialer, config *net.ListenConfig, listener IntraListener) (IntraTunnel, error) {
+	bootstrap := doh.NewBootstrap(bootstrapDNS)
+	dohdns, err := doh.NewTransportFromURL(dohURL, bootstrap, dialer, listener)
+	if err != nil {
+		return nil, err
+	}
+	return NewIntraTunnel(fakedns, udpdns, tcpdns, dohdns, fd, dialer, config, listener)
+}
+
 // Registers Intra's custom UDP and TCP connection handlers to the tun2socks core.
 func (t *intratunnel) registerConnectionHandlers(fakedns, udpdns, tcpdns string, dialer *net.Dialer, config *net.ListenConfig, listener IntraListener) error {
 	// RFC 5382 REQ-5 requires a timeout no shorter than 2 hours and 4 minutes.
@@ -116,9 +175,6 @@ func (t *intratunnel) registerConnectionHandlers(fakedns, udpdns, tcpdns string,
 	if err != nil {
 		return err
 	}
-	t.udp = intra.NewUDPHandler(*udpfakedns, *udptruedns, timeout, config, listener)
-	core.RegisterUDPConnHandler(t.udp)
-
 	tcpfakedns, err := net.ResolveTCPAddr("tcp", fakedns)
 	if err != nil {
 		return err
@@ -127,13 +183,50 @@ func (t *intratunnel) registerConnectionHandlers(fakedns, udpdns, tcpdns string,
 	if err != nil {
 		return err
 	}
-	t.tcp = intra.NewTCPHandler(*tcpfakedns, *tcptruedns, dialer, listener)
+
+	t.listener = listener
+
+	// `direct` is the one direct route shared by DNS sockets and, via the
+	// MultiDialer, by non-DNS traffic that isn't steered elsewhere by
+	// AddProxy/SetRoute.  Keeping a single shared instance means
+	// SetOutboundInterface's Control hook applies to every direct socket,
+	// not just some of them.
+	t.direct = intra.NewDirectDialer(dialer, config)
+	t.dialer = intra.NewMultiDialer(t.direct)
+
+	t.udp = intra.NewUDPHandler(*udpfakedns, *udptruedns, *tcptruedns, timeout, t.direct, t.dialer, listener)
+	core.RegisterUDPConnHandler(t.udp)
+
+	t.tcp = intra.NewTCPHandler(*tcpfakedns, *tcptruedns, t.direct, t.dialer, listener)
 	tcpForwarder := tcp.NewForwarder(t.netstack, 0, 10, tcphandler(nil))
 	t.netstack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
 	return nil
 }
 
-func (t *intratunnel) SetDNS(dns doh.Transport) {
+func (t *intratunnel) SetDNS(transports []doh.Transport) {
+	t.dnsTransports = transports
+	t.rebuildDNS()
+}
+
+func (t *intratunnel) SetDNSStrategy(strategy doh.Strategy) {
+	t.dnsStrategy = strategy
+	t.rebuildDNS()
+}
+
+// rebuildDNS composes the configured transports under the configured
+// strategy and installs the result as the active DNS transport.
+func (t *intratunnel) rebuildDNS() {
+	if len(t.dnsTransports) == 0 {
+		t.dns = nil
+		t.udp.SetDNS(nil)
+		t.tcp.SetDNS(nil)
+		return
+	}
+	var dns doh.Transport = doh.NewMultiTransport(t.dnsTransports, t.dnsStrategy)
+	if t.dnsCacheEnabled {
+		cacheListener, _ := t.listener.(doh.CacheListener)
+		dns = doh.NewCache(dns, cacheListener)
+	}
 	t.dns = dns
 	t.udp.SetDNS(dns)
 	t.tcp.SetDNS(dns)
@@ -143,6 +236,46 @@ func (t *intratunnel) GetDNS() doh.Transport {
 	return t.dns
 }
 
+func (t *intratunnel) SetDoT(transport dot.Transport) {
+	// dot.Transport's method set matches doh.Transport, so it can be used
+	// directly as the tunnel's sole DNS transport.
+	t.SetDNS([]doh.Transport{transport})
+}
+
 func (t *intratunnel) SetAlwaysSplitHTTPS(s bool) {
 	t.tcp.SetAlwaysSplitHTTPS(s)
 }
+
+func (t *intratunnel) SetDNSRetryOverTCP(enabled bool) {
+	t.udp.SetDNSRetryOverTCP(enabled)
+}
+
+func (t *intratunnel) AddProxy(id string, d intra.Dialer) {
+	t.dialer.AddProxy(id, d)
+}
+
+func (t *intratunnel) RemoveProxy(id string) {
+	t.dialer.RemoveProxy(id)
+}
+
+func (t *intratunnel) SetRoute(route func(*net.TCPAddr) string) {
+	t.dialer.SetRoute(route)
+}
+
+func (t *intratunnel) SetOutboundInterface(ifaceIndex int) error {
+	if ifaceIndex == 0 {
+		t.direct.SetControl(nil)
+		return nil
+	}
+	control, err := intra.BindToInterfaceControl(ifaceIndex)
+	if err != nil {
+		return err
+	}
+	t.direct.SetControl(control)
+	return nil
+}
+
+func (t *intratunnel) SetDNSCache(enabled bool) {
+	t.dnsCacheEnabled = enabled
+	t.rebuildDNS()
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Dialer abstracts outbound connection establishment so that the UDP and TCP
+// handlers can be routed through something other than a direct system dial:
+// a SOCKS5 or HTTP CONNECT proxy, or a MultiDialer choosing between several
+// of those per destination.
+//
+// ListenPacket's `addr` is the UDP association's destination, not a local
+// address to bind to: MultiDialer uses it to pick a route, and a proxying
+// implementation may use it to set up the association. Implementations must
+// still bind their own local socket appropriately; they must not treat
+// `addr` as something to listen on directly.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+	ListenPacket(network, addr string) (net.PacketConn, error)
+}
+
+// DirectDialer dials straight to the destination.  It is the Dialer Intra
+// used before proxy chaining existed, and remains the default and fallback
+// route; a single shared instance is also used for sockets (DNS or
+// otherwise) that must always go direct regardless of the configured route.
+//
+// Its socket Control hook can be swapped at any time via SetControl, e.g. to
+// bind future sockets to a particular network interface; `mu` guards that
+// hook so it can be changed safely while dials are in flight, since `dialer`
+// and `config` are shared templates copied per-call rather than mutated in
+// place.
+type DirectDialer struct {
+	dialer *net.Dialer
+	config *net.ListenConfig
+
+	mu      sync.RWMutex
+	control func(network, address string, c syscall.RawConn) error
+}
+
+// NewDirectDialer returns a DirectDialer that connects directly to
+// destinations, using `dialer` and `config` as templates for every dial
+// (their Control field is ignored; use SetControl instead).
+func NewDirectDialer(dialer *net.Dialer, config *net.ListenConfig) *DirectDialer {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if config == nil {
+		config = &net.ListenConfig{}
+	}
+	return &DirectDialer{dialer: dialer, config: config}
+}
+
+// SetControl installs `control` as the socket Control hook (see
+// net.Dialer.Control and net.ListenConfig.Control) used by all future dials
+// and listens.  A nil control restores plain, unbound sockets.
+func (d *DirectDialer) SetControl(control func(network, address string, c syscall.RawConn) error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.control = control
+}
+
+func (d *DirectDialer) getControl() func(network, address string, c syscall.RawConn) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.control
+}
+
+func (d *DirectDialer) Dial(network, addr string) (net.Conn, error) {
+	dialer := *d.dialer
+	dialer.Control = d.getControl()
+	return dialer.Dial(network, addr)
+}
+
+// ListenPacket ignores `addr` (the association's destination, per the
+// Dialer doc comment) and always binds a wildcard local UDP socket, since
+// there is no remote address a direct listen could meaningfully bind to.
+func (d *DirectDialer) ListenPacket(network, addr string) (net.PacketConn, error) {
+	config := *d.config
+	config.Control = d.getControl()
+	return config.ListenPacket(context.Background(), network, ":0")
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+
+package intra
+
+import (
+	"strings"
+	"syscall"
+)
+
+// IP_BOUND_IF and IPV6_BOUND_IF are not exposed by the standard syscall
+// package on darwin; these are their values from <netinet/in.h> and
+// <netinet6/in6.h> respectively.
+const (
+	sysIPBoundIF   = 25
+	sysIPV6BoundIF = 125
+)
+
+// BindToInterfaceControl returns a Control function (see net.Dialer.Control
+// and net.ListenConfig.Control) that binds sockets to the interface at
+// `ifaceIndex` via IP_BOUND_IF/IPV6_BOUND_IF.
+func BindToInterfaceControl(ifaceIndex int) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		if err := c.Control(func(fd uintptr) {
+			if strings.HasSuffix(network, "6") {
+				opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, sysIPV6BoundIF, ifaceIndex)
+			} else {
+				opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, sysIPBoundIF, ifaceIndex)
+			}
+		}); err != nil {
+			return err
+		}
+		return opErr
+	}, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package intra
+
+import (
+	"net"
+	"syscall"
+)
+
+// BindToInterfaceControl returns a Control function (see net.Dialer.Control
+// and net.ListenConfig.Control) that binds sockets to the interface at
+// `ifaceIndex` via SO_BINDTODEVICE.
+func BindToInterfaceControl(ifaceIndex int) (func(network, address string, c syscall.RawConn) error, error) {
+	iface, err := net.InterfaceByIndex(ifaceIndex)
+	if err != nil {
+		return nil, err
+	}
+	name := iface.Name
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		if err := c.Control(func(fd uintptr) {
+			opErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		}); err != nil {
+			return err
+		}
+		return opErr
+	}, nil
+}
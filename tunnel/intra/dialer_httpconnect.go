@@ -0,0 +1,79 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const httpConnectTimeout = 10 * time.Second
+
+// httpConnectDialer is a Dialer that tunnels TCP connections through an HTTP
+// proxy using the CONNECT method.  UDP has no equivalent in the HTTP CONNECT
+// model, so ListenPacket always fails.
+type httpConnectDialer struct {
+	proxyAddr string
+	username  string
+	password  string
+}
+
+// NewHTTPConnectDialer returns a Dialer that connects via the HTTP CONNECT
+// proxy at `proxyAddr`.  `username`/`password`, if non-empty, are sent as
+// Proxy-Authorization: Basic credentials.
+func NewHTTPConnectDialer(proxyAddr, username, password string) Dialer {
+	return &httpConnectDialer{proxyAddr: proxyAddr, username: username, password: password}
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.proxyAddr, httpConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(httpConnectTimeout))
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if d.username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + d.password))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http connect: proxy returned %s", resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *httpConnectDialer) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return nil, errors.New("http connect: UDP is not supported by HTTP CONNECT proxies")
+}
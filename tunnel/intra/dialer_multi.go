@@ -0,0 +1,116 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// DirectProxyID is the reserved proxy ID that always resolves to a direct
+// (unproxied) connection, regardless of the configured route.
+const DirectProxyID = ""
+
+// MultiDialer is a Dialer that chains several named Dialers together,
+// choosing one per destination via a caller-supplied route function.  It
+// lets upstream apps steer some traffic through Tor/Orbot/Warp-style
+// upstreams or a split-tunnel corp proxy, while the rest goes direct.
+type MultiDialer struct {
+	mu      sync.RWMutex
+	proxies map[string]Dialer
+	route   func(*net.TCPAddr) string
+	direct  Dialer
+}
+
+// NewMultiDialer returns a MultiDialer that uses `direct` for any
+// destination whose route function returns DirectProxyID, or before
+// SetRoute has been called.  A route to an ID with no registered proxy
+// fails the dial with an error.
+func NewMultiDialer(direct Dialer) *MultiDialer {
+	return &MultiDialer{
+		proxies: make(map[string]Dialer),
+		direct:  direct,
+	}
+}
+
+// AddProxy registers `d` under `id`, for use once a route selects it.
+func (m *MultiDialer) AddProxy(id string, d Dialer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.proxies[id] = d
+}
+
+// RemoveProxy unregisters the proxy previously added under `id`.
+func (m *MultiDialer) RemoveProxy(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.proxies, id)
+}
+
+// SetRoute installs the predicate used to choose a proxy ID for a
+// destination.  A nil route (the default) sends everything direct.
+func (m *MultiDialer) SetRoute(route func(*net.TCPAddr) string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.route = route
+}
+
+// dialerFor resolves the Dialer that should be used for `addr`.
+func (m *MultiDialer) dialerFor(addr string) (Dialer, error) {
+	m.mu.RLock()
+	route := m.route
+	direct := m.direct
+	m.mu.RUnlock()
+	if route == nil {
+		return direct, nil
+	}
+
+	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return direct, nil
+	}
+	id := route(tcpaddr)
+	if id == DirectProxyID {
+		return direct, nil
+	}
+
+	m.mu.RLock()
+	d, ok := m.proxies[id]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("intra: no proxy registered for id %q", id)
+	}
+	return d, nil
+}
+
+func (m *MultiDialer) Dial(network, addr string) (net.Conn, error) {
+	d, err := m.dialerFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial(network, addr)
+}
+
+// ListenPacket routes by `addr` (the association's destination) exactly
+// like Dial, then forwards the call unchanged; the chosen Dialer is
+// responsible for binding its own local socket appropriately.
+func (m *MultiDialer) ListenPacket(network, addr string) (net.PacketConn, error) {
+	d, err := m.dialerFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.ListenPacket(network, addr)
+}
@@ -0,0 +1,332 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	socks5Version         = 0x05
+	socks5AuthNone        = 0x00
+	socks5AuthUserPass    = 0x02
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+	socks5AtypIPv4        = 0x01
+	socks5AtypDomain      = 0x03
+	socks5AtypIPv6        = 0x04
+)
+
+const socks5HandshakeTimeout = 10 * time.Second
+
+type socks5Dialer struct {
+	proxyAddr string
+	username  string
+	password  string
+}
+
+// NewSOCKS5Dialer returns a Dialer (RFC 1928) that connects and listens
+// through the SOCKS5 proxy at `proxyAddr`.  `username` and `password` are
+// used for username/password auth (RFC 1929) if non-empty; otherwise the
+// "no authentication" method is requested.
+func NewSOCKS5Dialer(proxyAddr, username, password string) Dialer {
+	return &socks5Dialer{proxyAddr: proxyAddr, username: username, password: password}
+}
+
+func (d *socks5Dialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.proxyAddr, socks5HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	if err := d.handshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := d.request(conn, socks5CmdConnect, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// ListenPacket performs a SOCKS5 UDP ASSOCIATE and returns a PacketConn that
+// relays datagrams through the proxy, transparently adding/removing the
+// SOCKS5 UDP request header (RFC 1928 section 7).  The TCP control
+// connection used to establish the association is held open for as long as
+// the returned PacketConn is in use; closing the PacketConn closes it too.
+func (d *socks5Dialer) ListenPacket(network, addr string) (net.PacketConn, error) {
+	ctrl, err := net.DialTimeout("tcp", d.proxyAddr, socks5HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	if err := d.handshake(ctrl); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	relayAddr, err := d.request(ctrl, socks5CmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	udpAddr, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	return &socks5PacketConn{UDPConn: udp, ctrl: ctrl, relay: udpAddr}, nil
+}
+
+// handshake negotiates the SOCKS5 auth method and, if required, performs the
+// username/password sub-negotiation (RFC 1929).
+func (d *socks5Dialer) handshake(conn net.Conn) error {
+	methods := []byte{socks5AuthNone}
+	if d.username != "" {
+		methods = []byte{socks5AuthUserPass, socks5AuthNone}
+	}
+	req := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := readFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return errors.New("socks5: bad server version")
+	}
+	switch resp[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthUserPass:
+		return d.authUserPass(conn)
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+}
+
+func (d *socks5Dialer) authUserPass(conn net.Conn) error {
+	req := []byte{0x01}
+	req = append(req, byte(len(d.username)))
+	req = append(req, d.username...)
+	req = append(req, byte(len(d.password)))
+	req = append(req, d.password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := readFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
+
+// request sends a SOCKS5 command request for `addr` and returns the bound
+// address the proxy reports in its reply (the relay address, for UDP
+// ASSOCIATE; the bound address, for CONNECT).
+func (d *socks5Dialer) request(conn net.Conn, cmd byte, addr string) (string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	dst, err := encodeSOCKS5Addr(host, portStr)
+	if err != nil {
+		return "", err
+	}
+
+	req := append([]byte{socks5Version, cmd, 0x00}, dst...)
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+
+	header := make([]byte, 4)
+	if _, err := readFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[1] != 0x00 {
+		return "", fmt.Errorf("socks5: request failed with code %d", header[1])
+	}
+
+	return decodeSOCKS5Addr(conn, header[3])
+}
+
+func encodeSOCKS5Addr(host, portStr string) ([]byte, error) {
+	var port int
+	if _, err := fmt.Sscanf(portStr, "%d", &port); err != nil {
+		return nil, fmt.Errorf("socks5: bad port %q", portStr)
+	}
+	portBytes := []byte{byte(port >> 8), byte(port)}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return append(append([]byte{socks5AtypIPv4}, ip4...), portBytes...), nil
+		}
+		return append(append([]byte{socks5AtypIPv6}, ip.To16()...), portBytes...), nil
+	}
+	if len(host) > 255 {
+		return nil, errors.New("socks5: hostname too long")
+	}
+	out := append([]byte{socks5AtypDomain, byte(len(host))}, host...)
+	return append(out, portBytes...), nil
+}
+
+// decodeSOCKS5Addr reads the ATYP-tagged address that follows the 4-byte
+// reply header (`atyp` is header[3]) and returns it as "host:port".
+func decodeSOCKS5Addr(conn net.Conn, atyp byte) (string, error) {
+	switch atyp {
+	case socks5AtypIPv4:
+		buf := make([]byte, net.IPv4len+2)
+		if _, err := readFull(conn, buf); err != nil {
+			return "", err
+		}
+		port := int(buf[net.IPv4len])<<8 | int(buf[net.IPv4len+1])
+		return net.JoinHostPort(net.IP(buf[:net.IPv4len]).String(), fmt.Sprint(port)), nil
+	case socks5AtypIPv6:
+		buf := make([]byte, net.IPv6len+2)
+		if _, err := readFull(conn, buf); err != nil {
+			return "", err
+		}
+		port := int(buf[net.IPv6len])<<8 | int(buf[net.IPv6len+1])
+		return net.JoinHostPort(net.IP(buf[:net.IPv6len]).String(), fmt.Sprint(port)), nil
+	case socks5AtypDomain:
+		lenbuf := make([]byte, 1)
+		if _, err := readFull(conn, lenbuf); err != nil {
+			return "", err
+		}
+		buf := make([]byte, int(lenbuf[0])+2)
+		if _, err := readFull(conn, buf); err != nil {
+			return "", err
+		}
+		host := string(buf[:len(buf)-2])
+		port := int(buf[len(buf)-2])<<8 | int(buf[len(buf)-1])
+		return net.JoinHostPort(host, fmt.Sprint(port)), nil
+	default:
+		return "", fmt.Errorf("socks5: unsupported address type %d", atyp)
+	}
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// socks5PacketConn relays datagrams to/from a SOCKS5 UDP ASSOCIATE session,
+// adding or stripping the RFC 1928 section 7 UDP request header.
+type socks5PacketConn struct {
+	*net.UDPConn
+	ctrl  net.Conn // Control connection; the association dies when it closes.
+	relay *net.UDPAddr
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("socks5: WriteTo requires a *net.UDPAddr")
+	}
+	header, err := encodeSOCKS5Addr(udpaddr.IP.String(), fmt.Sprint(udpaddr.Port))
+	if err != nil {
+		return 0, err
+	}
+	packet := append([]byte{0x00, 0x00, 0x00}, header...)
+	packet = append(packet, b...)
+	if _, err := c.UDPConn.WriteToUDP(packet, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262) // room for the largest possible header
+	n, _, err := c.UDPConn.ReadFromUDP(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n < 4 {
+		return 0, nil, errors.New("socks5: short UDP relay packet")
+	}
+	payloadStart, srcAddr, err := parseSOCKS5UDPHeader(buf[:n])
+	if err != nil {
+		return 0, nil, err
+	}
+	copied := copy(b, buf[payloadStart:n])
+	return copied, srcAddr, nil
+}
+
+func (c *socks5PacketConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+func parseSOCKS5UDPHeader(packet []byte) (int, net.Addr, error) {
+	if packet[2] != 0x00 {
+		return 0, nil, errors.New("socks5: fragmented UDP packets are not supported")
+	}
+	switch packet[3] {
+	case socks5AtypIPv4:
+		if len(packet) < 4+net.IPv4len+2 {
+			return 0, nil, errors.New("socks5: short UDP header")
+		}
+		ip := net.IP(packet[4 : 4+net.IPv4len])
+		port := int(packet[4+net.IPv4len])<<8 | int(packet[4+net.IPv4len+1])
+		return 4 + net.IPv4len + 2, &net.UDPAddr{IP: ip, Port: port}, nil
+	case socks5AtypIPv6:
+		if len(packet) < 4+net.IPv6len+2 {
+			return 0, nil, errors.New("socks5: short UDP header")
+		}
+		ip := net.IP(packet[4 : 4+net.IPv6len])
+		port := int(packet[4+net.IPv6len])<<8 | int(packet[4+net.IPv6len+1])
+		return 4 + net.IPv6len + 2, &net.UDPAddr{IP: ip, Port: port}, nil
+	case socks5AtypDomain:
+		if len(packet) < 5 {
+			return 0, nil, errors.New("socks5: short UDP header")
+		}
+		domainLen := int(packet[4])
+		if len(packet) < 5+domainLen+2 {
+			return 0, nil, errors.New("socks5: short UDP header")
+		}
+		host := string(packet[5 : 5+domainLen])
+		port := int(packet[5+domainLen])<<8 | int(packet[5+domainLen+1])
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return 0, nil, fmt.Errorf("socks5: cannot resolve relayed domain %q", host)
+		}
+		return 5 + domainLen + 2, &net.UDPAddr{IP: ips[0], Port: port}, nil
+	default:
+		return 0, nil, fmt.Errorf("socks5: unsupported address type %d", packet[3])
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEncodeSOCKS5Addr(t *testing.T) {
+	cases := []struct {
+		host, port string
+		want       []byte
+	}{
+		{"93.184.216.34", "80", []byte{socks5AtypIPv4, 93, 184, 216, 34, 0, 80}},
+		{"::1", "443", append([]byte{socks5AtypIPv6}, append(net.ParseIP("::1").To16(), 1, 187)...)},
+		{"example.com", "443", append([]byte{socks5AtypDomain, 11}, append([]byte("example.com"), 1, 187)...)},
+	}
+	for _, c := range cases {
+		got, err := encodeSOCKS5Addr(c.host, c.port)
+		if err != nil {
+			t.Fatalf("encodeSOCKS5Addr(%q, %q): %v", c.host, c.port, err)
+		}
+		if string(got) != string(c.want) {
+			t.Errorf("encodeSOCKS5Addr(%q, %q) = %v, want %v", c.host, c.port, got, c.want)
+		}
+	}
+}
+
+func TestEncodeSOCKS5AddrErrors(t *testing.T) {
+	if _, err := encodeSOCKS5Addr("example.com", "not-a-port"); err == nil {
+		t.Error("encodeSOCKS5Addr should reject a non-numeric port")
+	}
+	longHost := make([]byte, 256)
+	for i := range longHost {
+		longHost[i] = 'a'
+	}
+	if _, err := encodeSOCKS5Addr(string(longHost), "443"); err == nil {
+		t.Error("encodeSOCKS5Addr should reject a hostname over 255 bytes")
+	}
+}
+
+func TestParseSOCKS5UDPHeaderIPv4(t *testing.T) {
+	packet := []byte{0, 0, 0, socks5AtypIPv4, 93, 184, 216, 34, 0, 80, 'h', 'i'}
+	n, addr, err := parseSOCKS5UDPHeader(packet)
+	if err != nil {
+		t.Fatalf("parseSOCKS5UDPHeader: %v", err)
+	}
+	if n != 10 {
+		t.Errorf("header length = %d, want 10", n)
+	}
+	want := &net.UDPAddr{IP: net.IPv4(93, 184, 216, 34), Port: 80}
+	got := addr.(*net.UDPAddr)
+	if !got.IP.Equal(want.IP) || got.Port != want.Port {
+		t.Errorf("parseSOCKS5UDPHeader addr = %v, want %v", got, want)
+	}
+	if string(packet[n:]) != "hi" {
+		t.Errorf("payload after header = %q, want %q", packet[n:], "hi")
+	}
+}
+
+func TestParseSOCKS5UDPHeaderFragmented(t *testing.T) {
+	packet := []byte{0, 0, 1, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, _, err := parseSOCKS5UDPHeader(packet); err == nil {
+		t.Error("parseSOCKS5UDPHeader should reject a fragmented packet (FRAG != 0)")
+	}
+}
+
+func TestParseSOCKS5UDPHeaderShort(t *testing.T) {
+	packet := []byte{0, 0, 0, socks5AtypIPv4, 1, 2, 3}
+	if _, _, err := parseSOCKS5UDPHeader(packet); err == nil {
+		t.Error("parseSOCKS5UDPHeader should reject a truncated IPv4 header")
+	}
+}
+
+func TestDecodeSOCKS5AddrIPv4(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go server.Write([]byte{93, 184, 216, 34, 0, 80})
+
+	addr, err := decodeSOCKS5Addr(client, socks5AtypIPv4)
+	if err != nil {
+		t.Fatalf("decodeSOCKS5Addr: %v", err)
+	}
+	if want := "93.184.216.34:80"; addr != want {
+		t.Errorf("decodeSOCKS5Addr = %q, want %q", addr, want)
+	}
+}
+
+func TestDecodeSOCKS5AddrDomain(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go server.Write(append([]byte{11}, append([]byte("example.com"), 1, 187)...))
+
+	addr, err := decodeSOCKS5Addr(client, socks5AtypDomain)
+	if err != nil {
+		t.Fatalf("decodeSOCKS5Addr: %v", err)
+	}
+	if want := "example.com:443"; addr != want {
+		t.Errorf("decodeSOCKS5Addr = %q, want %q", addr, want)
+	}
+}
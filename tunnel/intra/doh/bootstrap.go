@@ -0,0 +1,261 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+)
+
+// bootstrapMaxTTL caps how long a cached resolution is reused, even if the
+// upstream answer's own TTL is longer.
+const bootstrapMaxTTL = 5 * time.Minute
+
+// bootstrapQueryTimeout bounds a single query to one plain-DNS server.
+const bootstrapQueryTimeout = 5 * time.Second
+
+type bootstrapEntry struct {
+	ips    []net.IP
+	expiry time.Time
+}
+
+// Bootstrap resolves DOH/DOT server hostnames using a fixed list of
+// plain-DNS servers, for use before the tunnel's own resolver is available.
+type Bootstrap struct {
+	servers []string // "ip:port" plain DNS servers, tried in order
+
+	mu    sync.Mutex
+	cache map[string]bootstrapEntry
+}
+
+// NewBootstrap returns a Bootstrap that queries `servers` (each "ip:port")
+// in order until one answers.
+func NewBootstrap(servers []string) *Bootstrap {
+	return &Bootstrap{
+		servers: servers,
+		cache:   make(map[string]bootstrapEntry),
+	}
+}
+
+// Resolve returns the addresses for `host`, in happy-eyeballs order (IPv6
+// and IPv4 interleaved, starting with IPv6), reusing a cached answer if one
+// hasn't expired.
+func (b *Bootstrap) Resolve(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	b.mu.Lock()
+	entry, cached := b.cache[host]
+	b.mu.Unlock()
+	if cached && time.Now().Before(entry.expiry) {
+		return entry.ips, nil
+	}
+	return b.Refresh(host)
+}
+
+// Refresh re-queries the configured servers for `host`, bypassing any cached
+// answer, and updates the cache with the result.  Callers rebuilding a
+// transport after a dial failure (e.g. "no such host") should use this
+// instead of Resolve, which would otherwise just return the same stale entry.
+func (b *Bootstrap) Refresh(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	v6, ttl6, err6 := b.query(host, dnsTypeAAAA)
+	v4, ttl4, err4 := b.query(host, dnsTypeA)
+	if err6 != nil && err4 != nil {
+		return nil, err4
+	}
+
+	ips := interleave(v6, v4)
+	if len(ips) == 0 {
+		return nil, errors.New("bootstrap: no addresses found")
+	}
+
+	ttl := ttl6
+	if err6 != nil || (err4 == nil && ttl4 < ttl) {
+		ttl = ttl4
+	}
+	if ttl <= 0 || ttl > bootstrapMaxTTL {
+		ttl = bootstrapMaxTTL
+	}
+
+	b.mu.Lock()
+	b.cache[host] = bootstrapEntry{ips: ips, expiry: time.Now().Add(ttl)}
+	b.mu.Unlock()
+	return ips, nil
+}
+
+// interleave merges two address lists in happy-eyeballs order: one from the
+// first list, one from the second, alternating, starting with the first.
+func interleave(first, second []net.IP) []net.IP {
+	merged := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			merged = append(merged, first[i])
+		}
+		if i < len(second) {
+			merged = append(merged, second[i])
+		}
+	}
+	return merged
+}
+
+// query asks each configured server in turn for `host`'s records of `qtype`,
+// returning the decoded addresses and their minimum TTL.
+func (b *Bootstrap) query(host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	q := encodeDNSQuery(1, host, qtype)
+	var lastErr error
+	for _, server := range b.servers {
+		ips, ttl, err := queryServer(server, q)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("bootstrap: no servers configured")
+	}
+	return nil, 0, lastErr
+}
+
+func queryServer(server string, q []byte) ([]net.IP, time.Duration, error) {
+	conn, err := net.DialTimeout("udp", server, bootstrapQueryTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(bootstrapQueryTimeout))
+
+	if _, err := conn.Write(q); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodeDNSAnswer(buf[:n], qtype(q))
+}
+
+func qtype(q []byte) uint16 {
+	// The question's QTYPE is the two bytes preceding QCLASS, at the end of
+	// the (fixed-length, single-question) query we constructed ourselves.
+	return binary.BigEndian.Uint16(q[len(q)-4 : len(q)-2])
+}
+
+func encodeDNSQuery(id uint16, name string, qtype uint16) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, id)
+	buf.Write([]byte{0x01, 0x00})                   // flags: recursion desired
+	binary.Write(&buf, binary.BigEndian, uint16(1)) // QDCOUNT
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // ANCOUNT
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // NSCOUNT
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // ARCOUNT
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0)
+	binary.Write(&buf, binary.BigEndian, qtype)
+	binary.Write(&buf, binary.BigEndian, uint16(dnsClassIN))
+	return buf.Bytes()
+}
+
+// decodeDNSAnswer extracts the addresses of the A/AAAA records in a DNS
+// response, and the minimum TTL across all of its answer records.
+func decodeDNSAnswer(resp []byte, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(resp) < 12 {
+		return nil, 0, errors.New("bootstrap: response too short")
+	}
+	qdcount := binary.BigEndian.Uint16(resp[4:6])
+	ancount := binary.BigEndian.Uint16(resp[6:8])
+
+	off := 12
+	for i := uint16(0); i < qdcount; i++ {
+		var err error
+		if off, err = skipName(resp, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4 // QTYPE + QCLASS
+	}
+
+	var ips []net.IP
+	minTTL := bootstrapMaxTTL
+	for i := uint16(0); i < ancount; i++ {
+		var err error
+		if off, err = skipName(resp, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(resp) {
+			return nil, 0, errors.New("bootstrap: truncated record")
+		}
+		rtype := binary.BigEndian.Uint16(resp[off : off+2])
+		ttl := time.Duration(binary.BigEndian.Uint32(resp[off+4:off+8])) * time.Second
+		rdlength := int(binary.BigEndian.Uint16(resp[off+8 : off+10]))
+		off += 10
+		if off+rdlength > len(resp) {
+			return nil, 0, errors.New("bootstrap: truncated record data")
+		}
+		if ttl < minTTL {
+			minTTL = ttl
+		}
+		switch rtype {
+		case dnsTypeA:
+			if rdlength == net.IPv4len {
+				ips = append(ips, net.IP(append([]byte{}, resp[off:off+rdlength]...)))
+			}
+		case dnsTypeAAAA:
+			if rdlength == net.IPv6len {
+				ips = append(ips, net.IP(append([]byte{}, resp[off:off+rdlength]...)))
+			}
+		}
+		off += rdlength
+	}
+	return ips, minTTL, nil
+}
+
+// skipName advances past a (possibly compressed) DNS name starting at off,
+// returning the offset of the byte that follows it.
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errors.New("bootstrap: name runs past end of message")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xC0 == 0xC0:
+			// Compression pointer: 2 bytes, no further labels.
+			return off + 2, nil
+		default:
+			off += 1 + length
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInterleave(t *testing.T) {
+	v6a := net.ParseIP("::1")
+	v6b := net.ParseIP("::2")
+	v4a := net.ParseIP("127.0.0.1")
+	v4b := net.ParseIP("127.0.0.2")
+
+	cases := []struct {
+		name   string
+		first  []net.IP
+		second []net.IP
+		want   []net.IP
+	}{
+		{"empty", nil, nil, []net.IP{}},
+		{"first only", []net.IP{v6a, v6b}, nil, []net.IP{v6a, v6b}},
+		{"second only", nil, []net.IP{v4a, v4b}, []net.IP{v4a, v4b}},
+		{"even", []net.IP{v6a, v6b}, []net.IP{v4a, v4b}, []net.IP{v6a, v4a, v6b, v4b}},
+		{"uneven", []net.IP{v6a}, []net.IP{v4a, v4b}, []net.IP{v6a, v4a, v4b}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := interleave(c.first, c.second)
+			if len(got) != len(c.want) {
+				t.Fatalf("interleave(%v, %v) = %v, want %v", c.first, c.second, got, c.want)
+			}
+			for i := range got {
+				if !got[i].Equal(c.want[i]) {
+					t.Fatalf("interleave(%v, %v) = %v, want %v", c.first, c.second, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeDNSQuery(t *testing.T) {
+	q := encodeDNSQuery(0xABCD, "www.example.com", dnsTypeAAAA)
+
+	if id := binary.BigEndian.Uint16(q[:2]); id != 0xABCD {
+		t.Errorf("query ID = %#x, want %#x", id, 0xABCD)
+	}
+	if qtype(q) != dnsTypeAAAA {
+		t.Errorf("qtype(q) = %d, want %d", qtype(q), dnsTypeAAAA)
+	}
+	name, off, err := readQuestionName(q, 12)
+	if err != nil {
+		t.Fatalf("readQuestionName: %v", err)
+	}
+	if name != "www.example.com" {
+		t.Errorf("question name = %q, want %q", name, "www.example.com")
+	}
+	if off+4 != len(q) {
+		t.Errorf("QTYPE/QCLASS should immediately follow the question name")
+	}
+}
+
+// buildAnswer constructs a minimal wire-format response to the query
+// produced by encodeDNSQuery(id, "example.com", dnsTypeA), with a single A record.
+func buildAnswer(id uint16, ttl uint32, ip net.IP) []byte {
+	return buildNamedAnswer(id, "example.com", ttl, ip)
+}
+
+// buildNamedAnswer is like buildAnswer, but for an arbitrary question name.
+func buildNamedAnswer(id uint16, name string, ttl uint32, ip net.IP) []byte {
+	q := encodeDNSQuery(id, name, dnsTypeA)
+	resp := append([]byte{}, q...)
+	binary.BigEndian.PutUint16(resp[6:8], 1) // ANCOUNT = 1
+
+	// Answer: a pointer back to the question name, then TYPE/CLASS/TTL/RDLENGTH/RDATA.
+	resp = append(resp, 0xC0, 0x0C)
+	var rr [10]byte
+	binary.BigEndian.PutUint16(rr[0:2], dnsTypeA)
+	binary.BigEndian.PutUint16(rr[2:4], dnsClassIN)
+	binary.BigEndian.PutUint32(rr[4:8], ttl)
+	binary.BigEndian.PutUint16(rr[8:10], net.IPv4len)
+	resp = append(resp, rr[:]...)
+	resp = append(resp, ip.To4()...)
+	return resp
+}
+
+func TestDecodeDNSAnswer(t *testing.T) {
+	ip := net.ParseIP("93.184.216.34")
+	resp := buildAnswer(42, 300, ip)
+
+	ips, ttl, err := decodeDNSAnswer(resp, dnsTypeA)
+	if err != nil {
+		t.Fatalf("decodeDNSAnswer: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(ip) {
+		t.Errorf("decodeDNSAnswer ips = %v, want [%v]", ips, ip)
+	}
+	if ttl != 300*time.Second {
+		t.Errorf("decodeDNSAnswer ttl = %v, want %v", ttl, 300*time.Second)
+	}
+}
+
+func TestDecodeDNSAnswerTruncated(t *testing.T) {
+	if _, _, err := decodeDNSAnswer([]byte{0, 1, 2}, dnsTypeA); err == nil {
+		t.Error("decodeDNSAnswer on a too-short message should fail")
+	}
+}
+
+func TestSkipNameCompressionPointer(t *testing.T) {
+	msg := []byte{0x03, 'f', 'o', 'o', 0x00, 0xC0, 0x00}
+	off, err := skipName(msg, 5)
+	if err != nil {
+		t.Fatalf("skipName: %v", err)
+	}
+	if off != 7 {
+		t.Errorf("skipName stopped at %d, want 7 (a pointer is always 2 bytes)", off)
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheMaxEntries and cacheMaxBytes bound the LRU, whichever is hit first.
+	cacheMaxEntries = 512
+	cacheMaxBytes   = 1 << 20 // 1 MiB of wire-format responses
+
+	// cacheNegativeTTL is how long an NXDOMAIN or SERVFAIL answer is cached,
+	// per RFC 2308's guidance to use a short, server-independent window.
+	cacheNegativeTTL = 30 * time.Second
+
+	// cachePrefetchWindow is the fraction of an entry's original TTL, measured
+	// from expiry, within which a cache hit triggers a background refresh.
+	cachePrefetchWindow = 0.10
+
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+)
+
+// CacheStats reports a Cache's running totals of hits, misses and evictions,
+// as of the lookup that just completed.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+// CacheListener optionally receives cache statistics after every cache
+// lookup by a Cache.  A query that can't be keyed (not a single-question
+// DNS message) is passed straight through without a lookup or a
+// notification.  It is consulted via a type assertion, so a Transport's
+// existing Listener need not implement it just to use caching.
+type CacheListener interface {
+	OnCacheStats(*CacheStats)
+}
+
+type cacheEntry struct {
+	response    []byte
+	expiry      time.Time
+	originalTTL time.Duration
+	size        int
+}
+
+type cacheElem struct {
+	key   string
+	entry *cacheEntry
+}
+
+// Cache decorates a Transport with an LRU cache of recent responses, keyed
+// by (qname, qtype, qclass).  Positive responses are kept for their minimum
+// answer/authority TTL; NXDOMAIN and SERVFAIL responses are kept for
+// cacheNegativeTTL.  A hit whose remaining TTL is less than
+// cachePrefetchWindow of its original TTL is still served immediately, but
+// also triggers an asynchronous re-query to refresh the entry.
+type Cache struct {
+	transport Transport
+	listener  CacheListener
+
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	order     *list.List // Front = most recently used.
+	totalSize int
+
+	hits, misses, evictions int64
+}
+
+// NewCache wraps `transport` with an in-memory response cache.  `listener`,
+// if non-nil, is notified of cache statistics after every cache lookup.
+func NewCache(transport Transport, listener CacheListener) Transport {
+	return &Cache{
+		transport: transport,
+		listener:  listener,
+		entries:   make(map[string]*list.Element),
+		order:     list.New(),
+	}
+}
+
+func (c *Cache) GetURL() string {
+	return c.transport.GetURL()
+}
+
+func (c *Cache) Query(ctx context.Context, q []byte) ([]byte, error) {
+	key, ok := cacheKey(q)
+	if !ok {
+		return c.transport.Query(ctx, q)
+	}
+
+	if resp, prefetch, ok := c.lookup(key, q); ok {
+		if prefetch {
+			go c.refresh(key, q)
+		}
+		return resp, nil
+	}
+
+	resp, err := c.transport.Query(ctx, q)
+	if err != nil {
+		return resp, err
+	}
+	c.store(key, resp)
+	return resp, nil
+}
+
+// lookup returns the cached response for `key`, rewritten to `q`'s
+// transaction ID, and whether it's due for a background refresh.
+func (c *Cache) lookup(key string, q []byte) (response []byte, prefetch bool, ok bool) {
+	c.mu.Lock()
+	if elem, found := c.entries[key]; found {
+		entry := elem.Value.(*cacheElem).entry
+		if time.Now().After(entry.expiry) {
+			c.removeLocked(elem)
+		} else {
+			c.order.MoveToFront(elem)
+			remaining := time.Until(entry.expiry)
+			prefetch = entry.originalTTL > 0 &&
+				remaining < time.Duration(float64(entry.originalTTL)*cachePrefetchWindow)
+			response = rewriteID(entry.response, q)
+			ok = true
+		}
+	}
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	stats := &CacheStats{Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+	c.mu.Unlock()
+
+	if c.listener != nil {
+		c.listener.OnCacheStats(stats)
+	}
+	return response, prefetch, ok
+}
+
+// refresh re-queries the wrapped transport and updates the cache entry for
+// `key`, without blocking the caller that triggered it.  It runs on its own
+// background goroutine, so it uses its own context rather than one tied to
+// the lookup that triggered it.
+func (c *Cache) refresh(key string, q []byte) {
+	resp, err := c.transport.Query(context.Background(), q)
+	if err != nil {
+		return
+	}
+	c.store(key, resp)
+}
+
+func (c *Cache) store(key string, resp []byte) {
+	ttl, negative := responseTTL(resp)
+	if negative {
+		ttl = cacheNegativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	entry := &cacheEntry{
+		response:    append([]byte{}, resp...),
+		expiry:      time.Now().Add(ttl),
+		originalTTL: ttl,
+		size:        len(resp),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[key]; found {
+		c.totalSize -= elem.Value.(*cacheElem).entry.size
+		elem.Value = &cacheElem{key: key, entry: entry}
+		c.order.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.order.PushFront(&cacheElem{key: key, entry: entry})
+	}
+	c.totalSize += entry.size
+	c.evictLocked()
+}
+
+// evictLocked removes the least-recently-used entries until both caps are
+// satisfied.  c.mu must be held.
+func (c *Cache) evictLocked() {
+	for (len(c.entries) > cacheMaxEntries || c.totalSize > cacheMaxBytes) && c.order.Len() > 0 {
+		c.removeLocked(c.order.Back())
+		c.evictions++
+	}
+}
+
+// removeLocked drops `elem` from both the index and the LRU list without
+// counting it as an eviction (callers that mean to evict do so themselves).
+// c.mu must be held.
+func (c *Cache) removeLocked(elem *list.Element) {
+	ce := elem.Value.(*cacheElem)
+	delete(c.entries, ce.key)
+	c.totalSize -= ce.entry.size
+	c.order.Remove(elem)
+}
+
+// cacheKey returns the lowercased (qname, qtype, qclass) of a single-
+// question query, or ok=false if `q` isn't wire-format DNS we can key on.
+func cacheKey(q []byte) (key string, ok bool) {
+	if len(q) < 12 || binary.BigEndian.Uint16(q[4:6]) != 1 {
+		return "", false
+	}
+	name, off, err := readQuestionName(q, 12)
+	if err != nil || off+4 > len(q) {
+		return "", false
+	}
+	qtype := binary.BigEndian.Uint16(q[off : off+2])
+	qclass := binary.BigEndian.Uint16(q[off+2 : off+4])
+	return fmt.Sprintf("%s|%d|%d", strings.ToLower(name), qtype, qclass), true
+}
+
+// readQuestionName decodes the (uncompressed) name starting at `off`,
+// returning it and the offset of the byte that follows it.  A query's own
+// question name is never compressed, since nothing precedes it.
+func readQuestionName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	for {
+		if off >= len(msg) {
+			return "", 0, errors.New("doh: name runs past end of message")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return strings.Join(labels, "."), off + 1, nil
+		case length&0xC0 == 0xC0:
+			return "", 0, errors.New("doh: compressed name in question section")
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errors.New("doh: truncated label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// responseTTL returns the minimum TTL across the answer and authority
+// sections of a DNS response, and whether it's an NXDOMAIN/SERVFAIL that
+// should use the negative-caching window instead.
+func responseTTL(resp []byte) (ttl time.Duration, negative bool) {
+	if len(resp) < 12 {
+		return 0, false
+	}
+	if rcode := resp[3] & 0x0F; rcode == dnsRcodeNXDomain || rcode == dnsRcodeServFail {
+		return cacheNegativeTTL, true
+	}
+
+	qdcount := binary.BigEndian.Uint16(resp[4:6])
+	ancount := binary.BigEndian.Uint16(resp[6:8])
+	nscount := binary.BigEndian.Uint16(resp[8:10])
+
+	off := 12
+	for i := uint16(0); i < qdcount; i++ {
+		var err error
+		if off, err = skipName(resp, off); err != nil {
+			return 0, false
+		}
+		off += 4 // QTYPE + QCLASS
+	}
+
+	var min time.Duration
+	have := false
+	for i := uint16(0); i < ancount+nscount; i++ {
+		var err error
+		if off, err = skipName(resp, off); err != nil {
+			break
+		}
+		if off+10 > len(resp) {
+			break
+		}
+		rrttl := time.Duration(binary.BigEndian.Uint32(resp[off+4:off+8])) * time.Second
+		rdlength := int(binary.BigEndian.Uint16(resp[off+8 : off+10]))
+		off += 10 + rdlength
+		if off > len(resp) {
+			break
+		}
+		if !have || rrttl < min {
+			min, have = rrttl, true
+		}
+	}
+	if !have {
+		return 0, false
+	}
+	return min, false
+}
+
+// rewriteID returns a copy of a cached response with its transaction ID
+// replaced by `q`'s, so the caller can match it to the query it sent.
+func rewriteID(resp, q []byte) []byte {
+	out := append([]byte{}, resp...)
+	if len(out) >= 2 && len(q) >= 2 {
+		out[0], out[1] = q[0], q[1]
+	}
+	return out
+}
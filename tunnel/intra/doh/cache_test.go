@@ -0,0 +1,152 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	q := encodeDNSQuery(1, "WWW.Example.COM", dnsTypeAAAA)
+	key, ok := cacheKey(q)
+	if !ok {
+		t.Fatalf("cacheKey(%v) ok = false, want true", q)
+	}
+	if want := fmt.Sprintf("www.example.com|%d|%d", dnsTypeAAAA, dnsClassIN); key != want {
+		t.Errorf("cacheKey = %q, want %q", key, want)
+	}
+
+	// Two queries for the same name/type/class (but different IDs) must
+	// share a key, since the ID is rewritten on a cache hit.
+	other := encodeDNSQuery(2, "www.example.com", dnsTypeAAAA)
+	otherKey, ok := cacheKey(other)
+	if !ok || otherKey != key {
+		t.Errorf("cacheKey(%v) = (%q, %v), want (%q, true)", other, otherKey, ok, key)
+	}
+}
+
+func TestCacheKeyRejectsNonQuery(t *testing.T) {
+	if _, ok := cacheKey([]byte{0, 1, 2}); ok {
+		t.Error("cacheKey on a too-short message should reject it")
+	}
+
+	// QDCOUNT != 1 isn't something we know how to key.
+	q := encodeDNSQuery(1, "example.com", dnsTypeA)
+	q[4], q[5] = 0, 2 // QDCOUNT = 2
+	if _, ok := cacheKey(q); ok {
+		t.Error("cacheKey with QDCOUNT != 1 should reject it")
+	}
+}
+
+func TestResponseTTLPositive(t *testing.T) {
+	resp := buildAnswer(1, 300, net.ParseIP("93.184.216.34"))
+	ttl, negative := responseTTL(resp)
+	if negative {
+		t.Error("responseTTL on a successful answer should not be negative")
+	}
+	if ttl != 300*time.Second {
+		t.Errorf("responseTTL = %v, want %v", ttl, 300*time.Second)
+	}
+}
+
+func TestResponseTTLNegative(t *testing.T) {
+	resp := buildAnswer(1, 300, net.ParseIP("93.184.216.34"))
+	resp[3] = resp[3]&0xF0 | dnsRcodeNXDomain
+	ttl, negative := responseTTL(resp)
+	if !negative {
+		t.Error("responseTTL on an NXDOMAIN answer should be negative")
+	}
+	if ttl != cacheNegativeTTL {
+		t.Errorf("responseTTL = %v, want %v", ttl, cacheNegativeTTL)
+	}
+}
+
+func TestResponseTTLTruncated(t *testing.T) {
+	ttl, negative := responseTTL([]byte{0, 1, 2})
+	if ttl != 0 || negative {
+		t.Errorf("responseTTL on a truncated message = (%v, %v), want (0, false)", ttl, negative)
+	}
+}
+
+func TestRewriteID(t *testing.T) {
+	resp := buildAnswer(0xAAAA, 300, net.ParseIP("93.184.216.34"))
+	q := encodeDNSQuery(0xBBBB, "example.com", dnsTypeA)
+
+	out := rewriteID(resp, q)
+	if id := uint16(out[0])<<8 | uint16(out[1]); id != 0xBBBB {
+		t.Errorf("rewriteID id = %#x, want %#x", id, 0xBBBB)
+	}
+	// The original response must be left untouched.
+	if id := uint16(resp[0])<<8 | uint16(resp[1]); id != 0xAAAA {
+		t.Errorf("rewriteID mutated its input: id = %#x, want %#x", id, 0xAAAA)
+	}
+}
+
+// fakeTransport answers every query with a fixed response, counting queries.
+type fakeTransport struct {
+	resp    []byte
+	queries int
+}
+
+func (f *fakeTransport) Query(ctx context.Context, q []byte) ([]byte, error) {
+	f.queries++
+	return rewriteID(f.resp, q), nil
+}
+
+func (f *fakeTransport) GetURL() string { return "fake" }
+
+func TestCacheHitAvoidsRequery(t *testing.T) {
+	resp := buildAnswer(1, 300, net.ParseIP("93.184.216.34"))
+	fake := &fakeTransport{resp: resp}
+	cache := NewCache(fake, nil)
+
+	q := encodeDNSQuery(1, "example.com", dnsTypeA)
+	if _, err := cache.Query(context.Background(), q); err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if _, err := cache.Query(context.Background(), q); err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if fake.queries != 1 {
+		t.Errorf("transport was queried %d times, want 1 (second lookup should hit the cache)", fake.queries)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	fake := &fakeTransport{}
+	cache := NewCache(fake, nil).(*Cache)
+
+	for i := 0; i < cacheMaxEntries+1; i++ {
+		name := fmt.Sprintf("host%d.example.com", i)
+		fake.resp = buildNamedAnswer(1, name, 300, net.ParseIP("93.184.216.34"))
+		q := encodeDNSQuery(1, name, dnsTypeA)
+		if _, err := cache.Query(context.Background(), q); err != nil {
+			t.Fatalf("Query(%s): %v", name, err)
+		}
+	}
+
+	if got := len(cache.entries); got != cacheMaxEntries {
+		t.Errorf("cache holds %d entries, want %d (the oldest should have been evicted)", got, cacheMaxEntries)
+	}
+
+	firstKey, _ := cacheKey(encodeDNSQuery(1, "host0.example.com", dnsTypeA))
+	if _, found := cache.entries[firstKey]; found {
+		t.Error("least-recently-used entry should have been evicted, but is still cached")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects how a multiTransport dispatches a query across its
+// children.
+type Strategy int
+
+const (
+	// First always queries the highest-priority (first) transport.
+	First Strategy = iota
+	// RoundRobin cycles through the transports on successive queries.
+	RoundRobin
+	// Race queries the transports in priority order, staggered by
+	// backupDelay, and returns the first successful response.
+	Race
+)
+
+// backupDelay is the "well-known-host backup delay" between staggered
+// launches in Race mode: long enough that a healthy primary server almost
+// always wins, short enough that a blackholed primary doesn't stall the
+// query for a full timeout.
+const backupDelay = 200 * time.Millisecond
+
+type multiTransport struct {
+	children []Transport
+	strategy Strategy
+	next     uint32 // round-robin cursor, accessed atomically
+}
+
+// NewMultiTransport returns a Transport that dispatches queries across
+// `children` according to `strategy`.  `children` is in priority order: the
+// first entry is the primary server.
+func NewMultiTransport(children []Transport, strategy Strategy) Transport {
+	return &multiTransport{children: children, strategy: strategy}
+}
+
+func (t *multiTransport) GetURL() string {
+	if len(t.children) == 0 {
+		return ""
+	}
+	return t.children[0].GetURL()
+}
+
+func (t *multiTransport) Query(ctx context.Context, q []byte) ([]byte, error) {
+	if len(t.children) == 0 {
+		return nil, errors.New("doh: no transports configured")
+	}
+	switch t.strategy {
+	case RoundRobin:
+		idx := atomic.AddUint32(&t.next, 1) - 1
+		return t.children[int(idx)%len(t.children)].Query(ctx, q)
+	case Race:
+		return t.race(ctx, q)
+	default: // First
+		return t.children[0].Query(ctx, q)
+	}
+}
+
+// race launches a query against each child in priority order, staggered by
+// backupDelay, and returns the first successful response.  Losing queries
+// are canceled via their shared context as soon as a winner is found, so
+// they don't keep consuming upstream connections in the background.
+func (t *multiTransport) race(ctx context.Context, q []byte) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	results := make(chan result, len(t.children))
+
+	for i, child := range t.children {
+		delay := time.Duration(i) * backupDelay
+		child := child
+		go func() {
+			if delay > 0 {
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+			resp, err := child.Query(ctx, q)
+			select {
+			case results <- result{resp, err}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	var lastErr error
+	for range t.children {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				return r.resp, nil
+			}
+			lastErr = r.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
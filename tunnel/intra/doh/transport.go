@@ -0,0 +1,206 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dohMimeType = "application/dns-message"
+
+// transport is a single DNS-over-HTTPS server, queried with a pre-resolved IP
+// address (RFC 8484, using the POST method).
+type transport struct {
+	url      string
+	hostname string
+	port     string
+
+	bootstrap *Bootstrap // nil if constructed with a fixed IP
+
+	mu sync.RWMutex
+	ip string
+
+	client   http.Client
+	listener Listener
+}
+
+// NewTransport returns a DOH transport that sends queries to `rawurl`,
+// connecting directly to `ip` rather than resolving the hostname in `rawurl`.
+// `dialer` is used for all network activity; `listener`, if non-nil, is
+// notified of the outcome of every query.
+func NewTransport(rawurl, ip string, dialer *net.Dialer, listener Listener) (Transport, error) {
+	return newTransport(rawurl, ip, nil, dialer, listener)
+}
+
+// NewTransportFromURL returns a DOH transport that resolves the hostname in
+// `rawurl` via `bootstrap` instead of requiring a pre-resolved IP.  If a
+// connection subsequently fails because the cached address is stale, the
+// hostname is re-resolved and the failed query retried once against the
+// fresh address.
+func NewTransportFromURL(rawurl string, bootstrap *Bootstrap, dialer *net.Dialer, listener Listener) (Transport, error) {
+	if bootstrap == nil {
+		return nil, errors.New("doh: bootstrap is required")
+	}
+	parsedurl, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := bootstrap.Resolve(parsedurl.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	return newTransport(rawurl, ips[0].String(), bootstrap, dialer, listener)
+}
+
+func newTransport(rawurl, ip string, bootstrap *Bootstrap, dialer *net.Dialer, listener Listener) (Transport, error) {
+	parsedurl, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if parsedurl.Scheme != "https" {
+		return nil, fmt.Errorf("bad scheme %s", parsedurl.Scheme)
+	}
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	port := parsedurl.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	t := &transport{
+		url:       rawurl,
+		hostname:  parsedurl.Hostname(),
+		port:      port,
+		bootstrap: bootstrap,
+		ip:        ip,
+		listener:  listener,
+	}
+	// Resolve all dials to the transport's current IP address, regardless of
+	// hostname, since the system resolver is typically unavailable or
+	// untrusted when this transport is used.
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(t.getIP(), t.port))
+	}
+	t.client = http.Client{
+		Transport: &http.Transport{
+			DialContext:       dial,
+			ForceAttemptHTTP2: true,
+		},
+	}
+	return t, nil
+}
+
+func (t *transport) getIP() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.ip
+}
+
+// rebootstrap re-resolves the transport's hostname and updates the IP used
+// for future dials.  It is a no-op if the transport was constructed with a
+// fixed IP (no bootstrap).
+func (t *transport) rebootstrap() {
+	if t.bootstrap == nil {
+		return
+	}
+	ips, err := t.bootstrap.Refresh(t.hostname)
+	if err != nil || len(ips) == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.ip = ips[0].String()
+	t.mu.Unlock()
+}
+
+// looksLikeStaleAddress reports whether err looks like the kind of dial
+// failure a stale bootstrap resolution would produce.
+func looksLikeStaleAddress(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "no such host") ||
+		strings.Contains(err.Error(), "connection refused") ||
+		strings.Contains(err.Error(), "i/o timeout"))
+}
+
+func (t *transport) GetURL() string {
+	return t.url
+}
+
+func (t *transport) Query(ctx context.Context, q []byte) ([]byte, error) {
+	start := time.Now()
+	if t.listener != nil {
+		t.listener.OnQuery(t.url)
+	}
+
+	resp, status, err := t.doQuery(ctx, q)
+	if status == SendFailed && looksLikeStaleAddress(err) && t.bootstrap != nil {
+		t.rebootstrap()
+		resp, status, err = t.doQuery(ctx, q)
+	}
+	if t.listener != nil {
+		t.listener.OnResponse(&Summary{
+			Latency:  time.Since(start).Seconds(),
+			Query:    q,
+			Response: resp,
+			Server:   t.url,
+			Status:   status,
+		})
+	}
+	return resp, err
+}
+
+func (t *transport) doQuery(ctx context.Context, q []byte) ([]byte, int, error) {
+	if len(q) < 2 {
+		return nil, BadQuery, errors.New("query too short")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(q))
+	if err != nil {
+		return nil, BadQuery, err
+	}
+	req.Header.Set("Content-Type", dohMimeType)
+	req.Header.Set("Accept", dohMimeType)
+
+	httpResp, err := t.client.Do(req)
+	if err != nil {
+		return nil, SendFailed, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, HTTPError, fmt.Errorf("doh: http status %d", httpResp.StatusCode)
+	}
+
+	resp, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, BadResponse, err
+	}
+	if len(resp) < 2 {
+		return nil, BadResponse, errors.New("response too short")
+	}
+	// The DOH server ignores the query ID in the request; restore the
+	// original ID so the caller can match the response to its query.
+	resp[0], resp[1] = q[0], q[1]
+	return resp, Complete, nil
+}
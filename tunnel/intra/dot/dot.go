@@ -0,0 +1,62 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dot implements a DNS-over-TLS (RFC 7858) query transport.
+package dot
+
+import "context"
+
+// Query completion status codes, reported in a Summary.
+const (
+	// Complete indicates the query succeeded.
+	Complete = iota
+	// SendFailed indicates that the query could not be sent or its
+	// response could not be read.
+	SendFailed
+	// BadQuery indicates that the query could not be encoded.
+	BadQuery
+	// BadResponse indicates that the server's response could not be parsed.
+	BadResponse
+	// InternalError indicates an unexpected failure within the transport.
+	InternalError
+)
+
+// Summary is passed to a Listener when a DNS query completes.  It mirrors
+// doh.Summary, with QuerySize in place of the query/response bytes (DOT
+// queries are not retained once framed onto the wire).
+type Summary struct {
+	Latency   float64 // Response (or failure) latency in seconds
+	Server    string
+	Status    int
+	QuerySize int
+}
+
+// Listener receives the result of every query sent through a Transport.
+type Listener interface {
+	OnQuery(server string)
+	OnResponse(*Summary)
+}
+
+// Transport represents a DNS-over-TLS query transport.  Its method set
+// matches doh.Transport, so a *transport can be used anywhere a DOH
+// transport is expected.
+type Transport interface {
+	// Query issues a DNS query, provided as a raw wire-format message
+	// (including the 2-byte query ID), and returns the raw wire-format
+	// response.  Canceling `ctx` aborts an in-flight query.
+	Query(ctx context.Context, q []byte) ([]byte, error)
+	// GetURL returns the "dot://host:port" address of the server this
+	// transport queries.
+	GetURL() string
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dot
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// dotIdleTimeout closes and reopens the persistent connection if no bytes
+// are read from the server for this long.
+const dotIdleTimeout = 30 * time.Second
+
+const dotQueryTimeout = 10 * time.Second
+
+// pendingQuery tracks a single in-flight, pipelined query.
+type pendingQuery struct {
+	resp chan []byte
+	err  chan error
+}
+
+type transport struct {
+	addr   string // "host:853"
+	tlsCfg *tls.Config
+
+	listener Listener
+
+	mu      sync.Mutex
+	conn    *tls.Conn
+	pending map[uint16]*pendingQuery // keyed by DNS transaction ID; entries must be unique while in flight
+}
+
+// NewTransport returns a DNS-over-TLS transport that connects to `addr`
+// ("host:853"), opening a persistent, pipelined TLS connection on first use.
+// If `spkiPins` is non-empty, the server's certificate must additionally
+// carry a SHA-256 SPKI hash (base64-encoded) matching one of the pins, or
+// the handshake is rejected.
+func NewTransport(addr string, spkiPins []string, listener Listener) (Transport, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{ServerName: host}
+	if len(spkiPins) > 0 {
+		cfg.VerifyPeerCertificate = makeSPKIVerifier(spkiPins)
+	}
+	return &transport{
+		addr:     addr,
+		tlsCfg:   cfg,
+		listener: listener,
+		pending:  make(map[uint16]*pendingQuery),
+	}, nil
+}
+
+func (t *transport) GetURL() string {
+	return "dot://" + t.addr
+}
+
+func (t *transport) Query(ctx context.Context, q []byte) ([]byte, error) {
+	start := time.Now()
+	if t.listener != nil {
+		t.listener.OnQuery(t.addr)
+	}
+
+	resp, status, err := t.doQuery(ctx, q)
+	if t.listener != nil {
+		t.listener.OnResponse(&Summary{
+			Latency:   time.Since(start).Seconds(),
+			Server:    t.addr,
+			Status:    status,
+			QuerySize: len(q),
+		})
+	}
+	return resp, err
+}
+
+func (t *transport) doQuery(ctx context.Context, q []byte) ([]byte, int, error) {
+	if len(q) < 2 {
+		return nil, BadQuery, errors.New("dot: query too short")
+	}
+	id := binary.BigEndian.Uint16(q[:2])
+
+	t.mu.Lock()
+	if t.conn == nil {
+		if err := t.connectLocked(); err != nil {
+			t.mu.Unlock()
+			return nil, SendFailed, err
+		}
+	}
+	if _, collision := t.pending[id]; collision {
+		t.mu.Unlock()
+		return nil, SendFailed, fmt.Errorf("dot: query ID %d is already in flight", id)
+	}
+	conn := t.conn
+	pq := &pendingQuery{resp: make(chan []byte, 1), err: make(chan error, 1)}
+	t.pending[id] = pq
+	t.mu.Unlock()
+
+	framed := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(framed, uint16(len(q)))
+	copy(framed[2:], q)
+
+	conn.SetWriteDeadline(time.Now().Add(dotQueryTimeout))
+	if _, err := conn.Write(framed); err != nil {
+		t.removePending(id)
+		return nil, SendFailed, err
+	}
+
+	select {
+	case resp := <-pq.resp:
+		return resp, Complete, nil
+	case err := <-pq.err:
+		return nil, SendFailed, err
+	case <-time.After(dotQueryTimeout):
+		t.removePending(id)
+		return nil, SendFailed, fmt.Errorf("dot: query to %s timed out", t.addr)
+	case <-ctx.Done():
+		t.removePending(id)
+		return nil, SendFailed, ctx.Err()
+	}
+}
+
+func (t *transport) removePending(id uint16) {
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+}
+
+// connectLocked dials a new TLS connection and starts its reader loop.
+// t.mu must be held by the caller.
+func (t *transport) connectLocked() error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dotQueryTimeout}, "tcp", t.addr, t.tlsCfg)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	go t.readLoop(conn)
+	return nil
+}
+
+// readLoop demultiplexes pipelined responses by DNS transaction ID until the
+// connection fails or idles out, at which point all queries still awaiting a
+// response on this connection are failed; the next query reconnects.
+func (t *transport) readLoop(conn *tls.Conn) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(dotIdleTimeout))
+		var lbuf [2]byte
+		if _, err := io.ReadFull(conn, lbuf[:]); err != nil {
+			t.dropConn(conn, err)
+			return
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(lbuf[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.dropConn(conn, err)
+			return
+		}
+		if len(resp) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(resp[:2])
+
+		t.mu.Lock()
+		pq, ok := t.pending[id]
+		if ok {
+			delete(t.pending, id)
+		}
+		t.mu.Unlock()
+		if ok {
+			pq.resp <- resp
+		}
+	}
+}
+
+func (t *transport) dropConn(conn *tls.Conn, err error) {
+	t.mu.Lock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	pending := t.pending
+	t.pending = make(map[uint16]*pendingQuery)
+	t.mu.Unlock()
+
+	for _, pq := range pending {
+		pq.err <- err
+	}
+	conn.Close()
+}
+
+// makeSPKIVerifier returns a tls.Config.VerifyPeerCertificate callback that
+// accepts the connection only if one of the presented certificates' SHA-256
+// SPKI hash matches a configured (base64-encoded) pin.
+func makeSPKIVerifier(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	pinset := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pinset[pin] = true
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if pinset[base64.StdEncoding.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+		return errors.New("dot: no certificate matched the configured SPKI pins")
+	}
+}
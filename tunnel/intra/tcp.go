@@ -0,0 +1,250 @@
+// Copyright 2019 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Derived from go-tun2socks's "direct" handler under the Apache 2.0 license.
+
+package intra
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// DNSTransport is the subset of doh.Transport (and dot.Transport) that the
+// UDP and TCP handlers need in order to answer fakedns queries, kept local
+// to this package to avoid an import cycle with doh/dot.
+type DNSTransport interface {
+	Query(ctx context.Context, q []byte) ([]byte, error)
+}
+
+// Summary of a non-DNS TCP socket, reported when it is closed.
+type TCPSocketSummary struct {
+	UploadBytes   int64 // Amount uploaded (bytes)
+	DownloadBytes int64 // Amount downloaded (bytes)
+	Duration      int32 // How long the socket was open (seconds)
+	ServerPort    int16
+}
+
+type TCPListener interface {
+	OnTCPSocketClosed(*TCPSocketSummary)
+}
+
+// TCPHandler adapts core.TCPConnHandler with Intra's DNS controls.
+type TCPHandler interface {
+	core.TCPConnHandler
+	SetDNS(DNSTransport)
+	// SetAlwaysSplitHTTPS controls whether HTTPS ClientHellos are
+	// pre-emptively split across two TCP segments.
+	SetAlwaysSplitHTTPS(bool)
+}
+
+type tcpHandler struct {
+	sync.Mutex
+
+	fakedns net.TCPAddr
+	truedns net.TCPAddr
+	direct  Dialer // Always used for DNS sockets, regardless of `dialer`.
+	dialer  Dialer // Used for non-DNS sockets; may route through a proxy.
+
+	dns      DNSTransport
+	listener TCPListener
+
+	alwaysSplitHTTPS int32 // atomic bool
+}
+
+// NewTCPHandler makes a TCP handler with Intra-style DNS redirection:
+// connections to `fakedns` are answered from `dns` if set, or else
+// redirected to `truedns` via `direct`.  Non-DNS connections are opened via
+// `dialer`, so they can be routed through a proxy chain (see MultiDialer).
+// `direct` is shared with the rest of the tunnel so that
+// SetOutboundInterface-style controls apply uniformly.
+func NewTCPHandler(fakedns, truedns net.TCPAddr, direct, dialer Dialer, listener TCPListener) TCPHandler {
+	if direct == nil {
+		direct = NewDirectDialer(nil, nil)
+	}
+	if dialer == nil {
+		dialer = direct
+	}
+	return &tcpHandler{
+		fakedns:  fakedns,
+		truedns:  truedns,
+		direct:   direct,
+		dialer:   dialer,
+		listener: listener,
+	}
+}
+
+// SetDNS installs the DNS transport to use for fakedns connections.
+func (h *tcpHandler) SetDNS(dns DNSTransport) {
+	h.Lock()
+	defer h.Unlock()
+	h.dns = dns
+}
+
+func (h *tcpHandler) getDNS() DNSTransport {
+	h.Lock()
+	defer h.Unlock()
+	return h.dns
+}
+
+// SetAlwaysSplitHTTPS enables or disabled pre-emptive HTTPS ClientHello
+// splitting.  Disabled by default.
+func (h *tcpHandler) SetAlwaysSplitHTTPS(s bool) {
+	v := int32(0)
+	if s {
+		v = 1
+	}
+	atomic.StoreInt32(&h.alwaysSplitHTTPS, v)
+}
+
+// Handle routes a single TCP connection directly to its destination, except
+// connections to `fakedns`, which are answered from the configured DNS
+// transport (or redirected to `truedns` if none is set).  Non-DNS
+// connections are dialed through `dialer`, so they follow whatever route
+// AddProxy/SetRoute has installed for the destination; DNS connections
+// always go direct.
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	isDNS := target.IP.Equal(h.fakedns.IP) && target.Port == h.fakedns.Port
+
+	if isDNS {
+		if dns := h.getDNS(); dns != nil {
+			go h.serveDNS(conn, dns)
+			return nil
+		}
+		target = &h.truedns
+	}
+
+	dialer := h.dialer
+	if isDNS {
+		dialer = h.direct
+	}
+	upstream, err := dialer.Dial("tcp", target.String())
+	if err != nil {
+		conn.Close()
+		log.Errorf("failed to dial tcp target: %v", err)
+		return err
+	}
+
+	split := !isDNS && target.Port == 443 && atomic.LoadInt32(&h.alwaysSplitHTTPS) != 0
+	go h.forward(conn, upstream, target, split)
+	return nil
+}
+
+// serveDNS answers a pipelined sequence of length-prefixed (RFC 7766) DNS
+// queries read from `conn` using `dns`, until the connection is closed.
+func (h *tcpHandler) serveDNS(conn net.Conn, dns DNSTransport) {
+	defer conn.Close()
+	for {
+		var lbuf [2]byte
+		if _, err := io.ReadFull(conn, lbuf[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(lbuf[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp, err := dns.Query(context.Background(), query)
+		if err != nil {
+			log.Warnf("tcp dns query failed: %v", err)
+			return
+		}
+		out := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(out, uint16(len(resp)))
+		copy(out[2:], resp)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// forward proxies `conn` to `upstream` in both directions until one side
+// closes, optionally splitting the first upload write to evade SNI
+// inspection of a single TCP segment, then reports a TCPSocketSummary.
+func (h *tcpHandler) forward(conn net.Conn, upstream net.Conn, target *net.TCPAddr, split bool) {
+	start := time.Now()
+
+	var upload, download int64
+	done := make(chan struct{}, 2)
+	go func() {
+		upload = copyWithOptionalSplit(upstream, conn, split)
+		if cw, ok := upstream.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		download = copyWithOptionalSplit(conn, upstream, false)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	conn.Close()
+	upstream.Close()
+	if h.listener != nil {
+		h.listener.OnTCPSocketClosed(&TCPSocketSummary{
+			UploadBytes:   upload,
+			DownloadBytes: download,
+			Duration:      int32(time.Since(start).Seconds()),
+			ServerPort:    int16(target.Port),
+		})
+	}
+}
+
+// copyWithOptionalSplit copies from src to dst until EOF or error, returning
+// the number of bytes copied.  If split is true, the very first write is
+// broken into a 1-byte write followed by the rest, so that a censor
+// inspecting only the first TCP segment doesn't see a complete TLS
+// ClientHello (and its SNI).
+func copyWithOptionalSplit(dst io.Writer, src io.Reader, split bool) int64 {
+	buf := core.NewBytes(core.BufSize)
+	defer core.FreeBytes(buf)
+
+	var total int64
+	first := true
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			var werr error
+			if first && split && n > 1 {
+				if _, werr = dst.Write(buf[:1]); werr == nil {
+					var n2 int
+					n2, werr = dst.Write(buf[1:n])
+					n = 1 + n2
+				}
+			} else {
+				_, werr = dst.Write(buf[:n])
+			}
+			first = false
+			total += int64(n)
+			if werr != nil {
+				return total
+			}
+		}
+		if rerr != nil {
+			return total
+		}
+	}
+}
@@ -17,16 +17,30 @@
 package intra
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 )
 
+// dnsTCFlagMask is the truncation (TC) bit in byte 2 of a DNS header.
+const dnsTCFlagMask = 0x02
+
+// tcpRetryTimeout bounds the write+read of the synchronous TCP fallback in
+// queryOverTCP; the dial itself goes through `h.direct` and uses that
+// Dialer's own settings.  It is deliberately much shorter than `h.timeout` (the RFC
+// 5382 NAT idle timeout for the UDP socket), since this is a quick retry of
+// a single query, not a long-lived association.
+const tcpRetryTimeout = 5 * time.Second
+
 // Summary of a non-DNS UDP association, reported when it is discarded.
 type UDPSocketSummary struct {
 	UploadBytes   int64 // Amount uploaded (bytes)
@@ -39,45 +53,98 @@ type UDPListener interface {
 }
 
 type tracker struct {
-	conn     *net.UDPConn
+	conn     net.PacketConn
 	start    time.Time
 	upload   int64 // bytes
 	download int64 // bytes
 	// Parameters used to implement the single-query socket optimization:
-	complex bool   // True if the socket is not a oneshot DNS query.
-	queryid uint16 // The DNS query ID for this socket, if there is one.
+	complex    bool   // True if the socket is not a oneshot DNS query.
+	queryid    uint16 // The DNS query ID for this socket, if there is one.
+	querybytes []byte // The original query, saved so it can be replayed over TCP.
+}
+
+func makeTracker(conn net.PacketConn) *tracker {
+	return &tracker{conn, time.Now(), 0, 0, false, 0, nil}
 }
 
-func makeTracker(conn *net.UDPConn) *tracker {
-	return &tracker{conn, time.Now(), 0, 0, false, 0}
+// UDPHandler adapts core.UDPConnHandler with Intra's DNS controls.
+type UDPHandler interface {
+	core.UDPConnHandler
+	SetDNS(DNSTransport)
+	// SetDNSRetryOverTCP controls whether a truncated (TC-bit) UDP DNS
+	// response from `truedns` is transparently retried over TCP.
+	SetDNSRetryOverTCP(bool)
 }
 
 type udpHandler struct {
 	sync.Mutex
 
-	timeout  time.Duration
-	udpConns map[core.UDPConn]*tracker
-	fakedns  net.UDPAddr
-	truedns  net.UDPAddr
-	dns      DNSTransport
-	listener UDPListener
+	timeout time.Duration
+
+	udpConns   map[core.UDPConn]*tracker
+	fakedns    net.UDPAddr
+	truedns    net.UDPAddr
+	tcptruedns net.TCPAddr
+	direct     Dialer // Always used for DNS sockets, regardless of `dialer`.
+	dialer     Dialer // Used for non-DNS sockets; may route through a proxy.
+	dns        DNSTransport
+	listener   UDPListener
+
+	// dnsRetryOverTCP is an atomic bool (1 = enabled) consulted by fetchUDPInput.
+	dnsRetryOverTCP int32
 }
 
 // NewUDPHandler makes a UDP handler with Intra-style DNS redirection:
 // All packets are routed directly to their destination, except packets whose
 // destination is `fakedns`.  Those packets are redirected to `truedns`.
 // Similarly, packets arriving from `truedns` have the source address replaced
-// with `fakedns`.
+// with `fakedns`.  `tcptruedns` is the TCP location of the same resolver,
+// used to retry truncated UDP responses.  DNS sockets always use `direct`;
+// non-DNS sockets are opened via `dialer`, so they can be routed through a
+// proxy chain (see MultiDialer).  `direct` is shared with the rest of the
+// tunnel so that SetOutboundInterface-style controls apply uniformly.
 // TODO: Remove truedns once DOH is working well
-func NewUDPHandler(fakedns, truedns net.UDPAddr, dns DNSTransport, timeout time.Duration, listener UDPListener) core.UDPConnHandler {
+func NewUDPHandler(fakedns, truedns net.UDPAddr, tcptruedns net.TCPAddr, timeout time.Duration, direct, dialer Dialer, listener UDPListener) UDPHandler {
+	if direct == nil {
+		direct = NewDirectDialer(nil, nil)
+	}
+	if dialer == nil {
+		dialer = direct
+	}
 	return &udpHandler{
-		timeout:  timeout,
-		udpConns: make(map[core.UDPConn]*tracker, 8),
-		fakedns:  fakedns,
-		truedns:  truedns,
-		dns:      dns,
-		listener: listener,
+		timeout:         timeout,
+		udpConns:        make(map[core.UDPConn]*tracker, 8),
+		fakedns:         fakedns,
+		truedns:         truedns,
+		tcptruedns:      tcptruedns,
+		direct:          direct,
+		dialer:          dialer,
+		listener:        listener,
+		dnsRetryOverTCP: 1,
+	}
+}
+
+// SetDNS installs the DNS transport to use for fakedns queries.
+func (h *udpHandler) SetDNS(dns DNSTransport) {
+	h.Lock()
+	defer h.Unlock()
+	h.dns = dns
+}
+
+func (h *udpHandler) getDNS() DNSTransport {
+	h.Lock()
+	defer h.Unlock()
+	return h.dns
+}
+
+// SetDNSRetryOverTCP enables or disables the truncated-response TCP retry.
+// Retries are enabled by default.
+func (h *udpHandler) SetDNSRetryOverTCP(enabled bool) {
+	v := int32(0)
+	if enabled {
+		v = 1
 	}
+	atomic.StoreInt32(&h.dnsRetryOverTCP, v)
 }
 
 func queryid(data []byte) int32 {
@@ -114,6 +181,23 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, t *tracker) {
 				if t.queryid != uint16(responseid) {
 					// Something very strange is going on
 					t.complex = true
+				} else if n >= 12 && buf[2]&dnsTCFlagMask != 0 &&
+					atomic.LoadInt32(&h.dnsRetryOverTCP) != 0 && t.querybytes != nil {
+					// The reply was truncated; reissue the query over TCP and
+					// return that (complete) answer to the app instead.
+					if resp, err := h.queryOverTCP(t.querybytes); err == nil {
+						if len(resp) > len(buf) {
+							// The complete answer doesn't fit in the UDP read
+							// buffer; copying a prefix of it would hand the app a
+							// corrupted record, which is worse than the original
+							// truncated reply, so drop it and let that stand.
+							log.Warnf("dropping oversized TCP-retried DNS reply: %d bytes > %d byte buffer", len(resp), len(buf))
+						} else {
+							n = copy(buf, resp)
+						}
+					} else {
+						log.Warnf("failed to retry truncated DNS reply over TCP: %v", err)
+					}
 				}
 			}
 		} else {
@@ -135,8 +219,13 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, t *tracker) {
 }
 
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
-	bindAddr := &net.UDPAddr{IP: nil, Port: 0}
-	pc, err := net.ListenUDP(bindAddr.Network(), bindAddr)
+	// DNS traffic (to fakedns) is always direct; only non-DNS traffic is
+	// eligible for proxy routing.
+	dialer := h.direct
+	if !target.IP.Equal(h.fakedns.IP) || target.Port != h.fakedns.Port {
+		dialer = h.dialer
+	}
+	pc, err := dialer.ListenPacket("udp", target.String())
 	if err != nil {
 		log.Errorf("failed to bind udp address")
 		return err
@@ -150,8 +239,8 @@ func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
 	return nil
 }
 
-func (h *udpHandler) doDoh(conn core.UDPConn, data []byte) {
-	resp, err := h.dns.Query(data)
+func (h *udpHandler) doDoh(conn core.UDPConn, dns DNSTransport, data []byte) {
+	resp, err := dns.Query(context.Background(), data)
 	if err == nil {
 		conn.WriteFrom(resp, &h.fakedns)
 	}
@@ -168,10 +257,10 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 	}
 
 	if addr.IP.Equal(h.fakedns.IP) && addr.Port == h.fakedns.Port {
-		if h.dns != nil {
+		if dns := h.getDNS(); dns != nil {
 			// Use DOH.
 			dataCopy := append([]byte{}, data...)
-			go h.doDoh(conn, dataCopy)
+			go h.doDoh(conn, dns, dataCopy)
 		} else {
 			// Send the query to the real DNS server.
 			addr = &h.truedns
@@ -180,6 +269,7 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 				t.complex = true
 			} else if t.upload == 0 {
 				t.queryid = uint16(id)
+				t.querybytes = append([]byte{}, data...)
 			} else if t.queryid != uint16(id) {
 				t.complex = true
 			}
@@ -196,6 +286,37 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 	return nil
 }
 
+// queryOverTCP reissues a DNS query against tcptruedns, using the standard
+// 2-byte length-prefixed TCP DNS framing, and returns the (complete) answer.
+func (h *udpHandler) queryOverTCP(query []byte) ([]byte, error) {
+	conn, err := h.direct.Dial("tcp", h.tcptruedns.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(tcpRetryTimeout))
+
+	lbuf := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(lbuf, uint16(len(query)))
+	copy(lbuf[2:], query)
+	if _, err := conn.Write(lbuf); err != nil {
+		return nil, err
+	}
+
+	var lenbuf [2]byte
+	if _, err := io.ReadFull(conn, lenbuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenbuf[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if queryid(resp) != queryid(query) {
+		return nil, errors.New("dns id mismatch in tcp retry")
+	}
+	return resp, nil
+}
+
 func (h *udpHandler) Close(conn core.UDPConn) {
 	conn.Close()
 